@@ -0,0 +1,257 @@
+// Package template implements a small Graphite-style templating engine for
+// turning delimited keys (Graphite metric paths, MQTT topics, and similar)
+// into InfluxDB measurement/tag/field layouts. It is shared by any protocol
+// listener that needs to synthesize points from a structured key rather than
+// full line protocol, e.g. services/udp and services/mqtt.
+package template
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultSeparator is the delimiter used to split a key into parts when none
+// is configured.
+const DefaultSeparator = "."
+
+const (
+	measurementPart   = "measurement"
+	greedyMeasurement = "measurement*"
+	fieldPart         = "field"
+	greedyField       = "field*"
+	skipPart          = ""
+)
+
+// Template represents a single parsed "[filter] template [tags]" line, e.g.
+//
+//	sensor.* measurement.host.field
+//	region.host.measurement* region=us-west
+//
+// The optional leading filter restricts which keys the template applies to;
+// a template with no filter acts as the default/fallback.
+type Template struct {
+	filter      []string
+	parts       []string
+	defaultTags map[string]string
+	separator   string
+}
+
+// Parse parses a single template line using separator to split both the
+// filter and the template into parts. An empty separator defaults to ".".
+func Parse(line, separator string) (*Template, error) {
+	if separator == "" {
+		separator = DefaultSeparator
+	}
+
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) == 0 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid template %q: expected '[filter] template [tags]'", line)
+	}
+
+	var defaultTags map[string]string
+	if last := fields[len(fields)-1]; strings.Contains(last, "=") {
+		var err error
+		defaultTags, err = parseTags(last)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %s", line, err)
+		}
+		fields = fields[:len(fields)-1]
+	}
+
+	var filterStr, tmplStr string
+	switch len(fields) {
+	case 1:
+		tmplStr = fields[0]
+	case 2:
+		filterStr, tmplStr = fields[0], fields[1]
+	default:
+		return nil, fmt.Errorf("invalid template %q: expected '[filter] template [tags]'", line)
+	}
+
+	parts := strings.Split(tmplStr, separator)
+	if err := validateParts(parts); err != nil {
+		return nil, fmt.Errorf("invalid template %q: %s", line, err)
+	}
+
+	t := &Template{
+		parts:       parts,
+		defaultTags: defaultTags,
+		separator:   separator,
+	}
+	if filterStr != "" {
+		t.filter = strings.Split(filterStr, separator)
+	}
+	return t, nil
+}
+
+func validateParts(parts []string) error {
+	seenGreedyMeasurement, seenGreedyField := false, false
+	for _, p := range parts {
+		switch p {
+		case greedyMeasurement:
+			if seenGreedyMeasurement {
+				return fmt.Errorf("only one %q part is allowed", greedyMeasurement)
+			}
+			seenGreedyMeasurement = true
+		case greedyField:
+			if seenGreedyField {
+				return fmt.Errorf("only one %q part is allowed", greedyField)
+			}
+			seenGreedyField = true
+		}
+	}
+	return nil
+}
+
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q", kv)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// matches reports whether key, once split on separator, satisfies the
+// template's filter. A nil filter (no filter specified) matches everything.
+// The filter is checked against the leading segments of the key; any
+// remaining segments are left for Apply to decode.
+func (t *Template) matches(segments []string) bool {
+	if t.filter == nil {
+		return true
+	}
+	if len(t.filter) > len(segments) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f == "*" {
+			continue
+		}
+		if f != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply matches key's segments against the template's parts, returning the
+// resolved measurement, tags, and field name. Field is empty if the template
+// does not include a field/field* part.
+func (t *Template) Apply(key string) (measurement string, tags map[string]string, field string, err error) {
+	all := strings.Split(key, t.separator)
+	if len(all) < len(t.filter) {
+		return "", nil, "", fmt.Errorf("key %q is shorter than template filter %v", key, t.filter)
+	}
+	// The leading segments matched by the filter (if any) are a qualifier,
+	// not part of what the template decodes.
+	segments := all[len(t.filter):]
+
+	greedyCount := 0
+	for _, p := range t.parts {
+		if p == greedyMeasurement || p == greedyField {
+			greedyCount++
+		}
+	}
+
+	if greedyCount == 0 && len(segments) != len(t.parts) {
+		return "", nil, "", fmt.Errorf("key %q has %d parts, template expects %d", key, len(segments), len(t.parts))
+	}
+	if greedyCount != 0 && len(segments) < len(t.parts) {
+		return "", nil, "", fmt.Errorf("key %q has %d parts, template expects at least %d", key, len(segments), len(t.parts))
+	}
+
+	tags = make(map[string]string, len(t.defaultTags))
+	for k, v := range t.defaultTags {
+		tags[k] = v
+	}
+
+	var measurementParts []string
+	var fieldParts []string
+
+	// extra segments beyond the template's fixed parts are divided as evenly
+	// as possible among the greedy parts, with any remainder going to the
+	// earlier greedy parts, so a template combining measurement* and field*
+	// (e.g. "measurement*.field*") splits a key instead of both parts trying
+	// to consume the same leftover segments.
+	extra := len(segments) - len(t.parts)
+	share, remainder := 0, 0
+	if greedyCount > 0 {
+		share, remainder = extra/greedyCount, extra%greedyCount
+	}
+	segIdx, greedySeen := 0, 0
+	for _, p := range t.parts {
+		n := 1
+		if p == greedyMeasurement || p == greedyField {
+			n = 1 + share
+			if greedySeen < remainder {
+				n++
+			}
+			greedySeen++
+		}
+		seg := strings.Join(segments[segIdx:segIdx+n], t.separator)
+		segIdx += n
+
+		switch p {
+		case measurementPart, greedyMeasurement:
+			measurementParts = append(measurementParts, seg)
+		case fieldPart, greedyField:
+			fieldParts = append(fieldParts, seg)
+		case skipPart:
+			// ignored segment
+		default:
+			tags[p] = seg
+		}
+	}
+
+	measurement = strings.Join(measurementParts, t.separator)
+	if measurement == "" {
+		return "", nil, "", fmt.Errorf("template %v did not resolve a measurement for key %q", t.parts, key)
+	}
+	field = strings.Join(fieldParts, t.separator)
+
+	return measurement, tags, field, nil
+}
+
+// Engine applies the first matching Template, in the order given to
+// NewEngine, to a delimited key. Templates with no filter act as the
+// default/fallback and are typically listed last.
+type Engine struct {
+	templates []*Template
+	separator string
+}
+
+// NewEngine parses patterns (one template line per entry) and returns an
+// Engine that applies them in order. separator defaults to "." when empty.
+func NewEngine(patterns []string, separator string) (*Engine, error) {
+	if separator == "" {
+		separator = DefaultSeparator
+	}
+
+	e := &Engine{separator: separator}
+	for _, p := range patterns {
+		t, err := Parse(p, separator)
+		if err != nil {
+			return nil, err
+		}
+		e.templates = append(e.templates, t)
+	}
+	return e, nil
+}
+
+// Apply finds the first template whose filter matches key and applies it.
+// It returns an error if no template matches.
+func (e *Engine) Apply(key string) (measurement string, tags map[string]string, field string, err error) {
+	segments := strings.Split(key, e.separator)
+	for _, t := range e.templates {
+		if t.matches(segments) {
+			return t.Apply(key)
+		}
+	}
+	return "", nil, "", fmt.Errorf("no template found for key %q", key)
+}
+
+// Len returns the number of templates loaded into the engine.
+func (e *Engine) Len() int { return len(e.templates) }
@@ -0,0 +1,96 @@
+package template_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb/pkg/template"
+)
+
+func TestTemplate_Apply(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		key         string
+		measurement string
+		tags        map[string]string
+		field       string
+	}{
+		{
+			name:        "simple measurement.host.field",
+			pattern:     "measurement.host.field",
+			key:         "cpu.server01.idle",
+			measurement: "cpu",
+			tags:        map[string]string{"host": "server01"},
+			field:       "idle",
+		},
+		{
+			name:        "filtered template skips the matched prefix",
+			pattern:     "sensor.* measurement.host.field",
+			key:         "sensor.device42.cpu.server01.idle",
+			measurement: "cpu",
+			tags:        map[string]string{"host": "server01"},
+			field:       "idle",
+		},
+		{
+			name:        "greedy measurement with default tags",
+			pattern:     "region.host.measurement* datacenter=us-west",
+			key:         "useast.server01.disk.free",
+			measurement: "disk.free",
+			tags:        map[string]string{"datacenter": "us-west", "region": "useast", "host": "server01"},
+		},
+		{
+			name:        "greedy measurement and greedy field split the leftover segments",
+			pattern:     "measurement*.field*",
+			key:         "a.b.c.d.e",
+			measurement: "a.b.c",
+			tags:        map[string]string{},
+			field:       "d.e",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := template.Parse(tc.pattern, "")
+			if err != nil {
+				t.Fatalf("Parse(%q) returned error: %s", tc.pattern, err)
+			}
+
+			measurement, tags, field, err := tmpl.Apply(tc.key)
+			if err != nil {
+				t.Fatalf("Apply(%q) returned error: %s", tc.key, err)
+			}
+			if measurement != tc.measurement {
+				t.Errorf("measurement = %q, want %q", measurement, tc.measurement)
+			}
+			if field != tc.field {
+				t.Errorf("field = %q, want %q", field, tc.field)
+			}
+			if !reflect.DeepEqual(tags, tc.tags) {
+				t.Errorf("tags = %v, want %v", tags, tc.tags)
+			}
+		})
+	}
+}
+
+func TestEngine_Apply(t *testing.T) {
+	e, err := template.NewEngine([]string{
+		"sensor.* measurement.host.field",
+		"measurement.host.field",
+	}, "")
+	if err != nil {
+		t.Fatalf("NewEngine returned error: %s", err)
+	}
+
+	measurement, tags, field, err := e.Apply("sensor.device1.cpu.server02.idle")
+	if err != nil {
+		t.Fatalf("Apply returned error: %s", err)
+	}
+	if measurement != "cpu" || field != "idle" || tags["host"] != "server02" {
+		t.Errorf("got measurement=%q field=%q tags=%v", measurement, field, tags)
+	}
+
+	if _, _, _, err := e.Apply("a.b"); err == nil {
+		t.Fatal("expected error for key that no template can decode")
+	}
+}
@@ -0,0 +1,239 @@
+package mqtt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/influxdata/influxdb/monitor/diagnostics"
+	"github.com/influxdata/influxdb/toml"
+)
+
+const (
+	// DefaultBindAddress is the default broker URL if none is specified.
+	DefaultBindAddress = "tcp://localhost:1883"
+
+	// DefaultDatabase is the default database for MQTT traffic.
+	DefaultDatabase = "mqtt"
+
+	// DefaultRetentionPolicy is the default retention policy used for writes.
+	DefaultRetentionPolicy = ""
+
+	// DefaultBatchSize is the default MQTT batch size.
+	DefaultBatchSize = 5000
+
+	// DefaultBatchPending is the default number of pending MQTT batches.
+	DefaultBatchPending = 10
+
+	// DefaultBatchTimeout is the default MQTT batch timeout.
+	DefaultBatchTimeout = time.Second
+
+	// DefaultPrecision is the default time precision used for MQTT services.
+	DefaultPrecision = "n"
+
+	// DefaultWriters is the default number of writers.
+	DefaultWriters = 1
+
+	// DefaultQoS is the default quality-of-service level used for subscriptions.
+	DefaultQoS = 0
+
+	// DefaultKeepAlive is the default keep-alive interval sent to the broker.
+	DefaultKeepAlive = 30 * time.Second
+
+	// DefaultConnectRetryInterval is the default delay between reconnect attempts.
+	DefaultConnectRetryInterval = time.Second
+
+	// DefaultMaxConnectRetryInterval caps the exponential reconnect backoff.
+	DefaultMaxConnectRetryInterval = time.Minute
+)
+
+// Topic describes a single MQTT subscription and how payloads received on it
+// should be written.
+type Topic struct {
+	// Filter is the MQTT topic filter to subscribe to, e.g. "sensors/+/temperature".
+	Filter string `toml:"filter"`
+
+	// Database and RetentionPolicy override the service-wide defaults for
+	// points received on this topic.
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention-policy"`
+	Precision       string `toml:"precision"`
+
+	// QoS is the quality-of-service level to request for this subscription.
+	QoS byte `toml:"qos"`
+
+	// Template is a pkg/template pattern ("[filter] template [tags]") applied
+	// to the received topic, using "/" as the separator, to synthesize a
+	// point's measurement/tags when the payload is not already line
+	// protocol, e.g. "sensors measurement" applied to topic
+	// "sensors/temperature" yields measurement "temperature".
+	Template string `toml:"template"`
+}
+
+// Validate returns an error if the Topic is invalid.
+func (t Topic) Validate() error {
+	if t.Filter == "" {
+		return errors.New("mqtt topic filter must not be empty")
+	}
+	if t.QoS > 2 {
+		return errors.New("mqtt topic qos must be 0, 1, or 2")
+	}
+	return nil
+}
+
+// Config holds various configuration settings for the MQTT service.
+type Config struct {
+	Enabled bool `toml:"enabled"`
+
+	// Brokers is the list of MQTT broker URLs to connect to, e.g.
+	// "tcp://localhost:1883" or "ssl://localhost:8883". The client
+	// connects to the first broker that accepts the connection and will
+	// fail over to the others on disconnect.
+	Brokers []string `toml:"brokers"`
+
+	ClientID string `toml:"client-id"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+
+	// CleanSession instructs the broker to discard any previous session
+	// state for ClientID on connect.
+	CleanSession bool `toml:"clean-session"`
+
+	KeepAlive            toml.Duration `toml:"keep-alive"`
+	ConnectRetryInterval toml.Duration `toml:"connect-retry-interval"`
+
+	// TLS settings, used when a broker URL uses the ssl:// or tls:// scheme.
+	SSLCA   string `toml:"ssl-ca"`
+	SSLCert string `toml:"ssl-cert"`
+	SSLKey  string `toml:"ssl-key"`
+
+	// InsecureSkipVerify disables certificate verification of the broker.
+	// This is insecure and should only be used for testing.
+	InsecureSkipVerify bool `toml:"insecure-skip-verify"`
+
+	// Database and RetentionPolicy are the defaults used for any Topic that
+	// does not specify its own.
+	Database        string `toml:"database"`
+	RetentionPolicy string `toml:"retention-policy"`
+	Precision       string `toml:"precision"`
+
+	BatchSize    int           `toml:"batch-size"`
+	BatchPending int           `toml:"batch-pending"`
+	BatchTimeout toml.Duration `toml:"batch-timeout"`
+	Writers      int           `toml:"writers"`
+
+	// Topics is the set of topic filters to subscribe to. At least one is
+	// required for the service to do anything useful.
+	Topics []Topic `toml:"topics"`
+}
+
+// NewConfig returns a new instance of Config with defaults.
+func NewConfig() Config {
+	return Config{
+		Brokers:              []string{DefaultBindAddress},
+		Database:             DefaultDatabase,
+		RetentionPolicy:      DefaultRetentionPolicy,
+		BatchSize:            DefaultBatchSize,
+		BatchPending:         DefaultBatchPending,
+		BatchTimeout:         toml.Duration(DefaultBatchTimeout),
+		Precision:            DefaultPrecision,
+		Writers:              DefaultWriters,
+		KeepAlive:            toml.Duration(DefaultKeepAlive),
+		ConnectRetryInterval: toml.Duration(DefaultConnectRetryInterval),
+	}
+}
+
+// WithDefaults takes the given config and returns a new config with any
+// required default values set.
+func (c *Config) WithDefaults() *Config {
+	d := *c
+	if len(d.Brokers) == 0 {
+		d.Brokers = []string{DefaultBindAddress}
+	}
+	if d.Database == "" {
+		d.Database = DefaultDatabase
+	}
+	if d.BatchSize == 0 {
+		d.BatchSize = DefaultBatchSize
+	}
+	if d.BatchPending == 0 {
+		d.BatchPending = DefaultBatchPending
+	}
+	if d.BatchTimeout == 0 {
+		d.BatchTimeout = toml.Duration(DefaultBatchTimeout)
+	}
+	if d.Precision == "" {
+		d.Precision = DefaultPrecision
+	}
+	if d.Writers == 0 {
+		d.Writers = DefaultWriters
+	}
+	if d.KeepAlive == 0 {
+		d.KeepAlive = toml.Duration(DefaultKeepAlive)
+	}
+	if d.ConnectRetryInterval == 0 {
+		d.ConnectRetryInterval = toml.Duration(DefaultConnectRetryInterval)
+	}
+	for i := range d.Topics {
+		if d.Topics[i].Database == "" {
+			d.Topics[i].Database = d.Database
+		}
+		if d.Topics[i].RetentionPolicy == "" {
+			d.Topics[i].RetentionPolicy = d.RetentionPolicy
+		}
+		if d.Topics[i].Precision == "" {
+			d.Topics[i].Precision = d.Precision
+		}
+	}
+	return &d
+}
+
+// Validate returns an error if the Config is invalid.
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Brokers) == 0 {
+		return errors.New("mqtt: at least one broker is required")
+	}
+	if len(c.Topics) == 0 {
+		return errors.New("mqtt: at least one topic is required")
+	}
+	for _, t := range c.Topics {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Configs wraps a slice of Config to aggregate diagnostics.
+type Configs []Config
+
+// Diagnostics returns one set of diagnostics for all of the Configs.
+func (c Configs) Diagnostics() (*diagnostics.Diagnostics, error) {
+	d := &diagnostics.Diagnostics{
+		Columns: []string{"enabled", "brokers", "client-id", "database", "retention-policy", "batch-size", "batch-pending", "batch-timeout", "precision", "writers", "topics"},
+	}
+
+	for _, cc := range c {
+		if !cc.Enabled {
+			d.AddRow([]interface{}{false})
+			continue
+		}
+
+		r := []interface{}{true, cc.Brokers, cc.ClientID, cc.Database, cc.RetentionPolicy, cc.BatchSize, cc.BatchPending, cc.BatchTimeout, cc.Precision, cc.Writers, len(cc.Topics)}
+		d.AddRow(r)
+	}
+
+	return d, nil
+}
+
+// Enabled returns true if any underlying Config is Enabled.
+func (c Configs) Enabled() bool {
+	for _, cc := range c {
+		if cc.Enabled {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,446 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/monitor/diagnostics"
+	"github.com/influxdata/influxdb/pkg/template"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// statistics gathered by the mqtt package.
+const (
+	statPointsReceived      = "pointsRx"
+	statBytesReceived       = "bytesRx"
+	statPointsParseFail     = "pointsParseFail"
+	statBatchesTransmitted  = "batchesTx"
+	statPointsTransmitted   = "pointsTx"
+	statBatchesTransmitFail = "batchesTxFail"
+	statConnectionsActive   = "connectionsActive"
+	statReconnects          = "reconnects"
+)
+
+// Service represents a service for subscribing to MQTT topics and ingesting
+// line-protocol (or templated) payloads, mirroring the batching semantics of
+// services/udp.
+type Service struct {
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	client paho.Client
+
+	// destBatchers pools a topic's points by the (database, retention-policy)
+	// pair it writes to, keyed by destinationKey, so that a single batch
+	// never mixes points bound for different destinations. Each pool holds
+	// config.Writers batchers for write parallelism within that destination.
+	destBatchers map[string][]*tsdb.PointBatcher
+	topicDest    []string // parallel to config.Topics: each topic's destinationKey
+
+	config    Config
+	templates []*template.Engine // parallel to config.Topics; nil entry if a topic has no Template
+
+	PointsWriter interface {
+		WritePointsPrivileged(database, retentionPolicy string, consistencyLevel models.ConsistencyLevel, points []models.Point) error
+	}
+
+	MetaClient interface {
+		CreateDatabase(name string) (*meta.DatabaseInfo, error)
+	}
+
+	Logger      *zap.Logger
+	stats       Statistics
+	defaultTags models.StatisticTags
+}
+
+// Statistics tracks statistics for the MQTT service.
+type Statistics struct {
+	PointsReceived      int64
+	BytesReceived       int64
+	PointsParseFail     int64
+	BatchesTransmitted  int64
+	PointsTransmitted   int64
+	BatchesTransmitFail int64
+	ConnectionsActive   int64
+	Reconnects          int64
+}
+
+// NewService returns a new instance of Service.
+func NewService(c Config) *Service {
+	return &Service{
+		config:      c,
+		closing:     make(chan struct{}),
+		Logger:      zap.NewNop(),
+		defaultTags: models.StatisticTags{"bind": strings.Join(c.Brokers, ",")},
+	}
+}
+
+// Open starts the service, connecting to the configured brokers and
+// subscribing to the configured topics.
+func (s *Service) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.config.Enabled {
+		return nil
+	}
+
+	s.Logger.Info("Starting mqtt service")
+
+	if s.PointsWriter == nil {
+		return fmt.Errorf("mqtt: WritePointsPrivileged is nil")
+	}
+
+	// Resolve each topic's Database/RetentionPolicy/Precision against the
+	// service-wide defaults so every topic has its own destination settled
+	// before batchers are built for it.
+	s.config = *s.config.WithDefaults()
+
+	if db := s.config.Database; db != "" {
+		if _, err := s.MetaClient.CreateDatabase(db); err != nil {
+			return fmt.Errorf("mqtt: create database %q: %s", db, err)
+		}
+	}
+
+	s.templates = make([]*template.Engine, len(s.config.Topics))
+	for i, t := range s.config.Topics {
+		if t.Template == "" {
+			continue
+		}
+		e, err := template.NewEngine([]string{t.Template}, "/")
+		if err != nil {
+			return fmt.Errorf("mqtt: invalid template for topic %q: %s", t.Filter, err)
+		}
+		s.templates[i] = e
+	}
+
+	if err := s.openDestinations(); err != nil {
+		return err
+	}
+
+	opts, err := s.clientOptions()
+	if err != nil {
+		return err
+	}
+
+	s.client = paho.NewClient(opts)
+	if token := s.client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("mqtt: connect: %s", token.Error())
+	}
+
+	return nil
+}
+
+// openDestinations builds one batcher pool per distinct (database,
+// retention-policy) pair among config.Topics and starts a writer goroutine
+// per batcher, so a batch of points is never pooled across destinations.
+// config.Topics must already have Database/RetentionPolicy resolved (see
+// Config.WithDefaults). Split out of Open so tests can exercise the routing
+// without a live broker connection.
+func (s *Service) openDestinations() error {
+	writers := s.config.Writers
+	if writers < 1 {
+		writers = 1
+	}
+
+	s.destBatchers = make(map[string][]*tsdb.PointBatcher)
+	s.topicDest = make([]string, len(s.config.Topics))
+	for i, t := range s.config.Topics {
+		key := destinationKey(t.Database, t.RetentionPolicy)
+		s.topicDest[i] = key
+		if _, ok := s.destBatchers[key]; ok {
+			continue
+		}
+
+		if t.Database != "" && t.Database != s.config.Database {
+			if _, err := s.MetaClient.CreateDatabase(t.Database); err != nil {
+				return fmt.Errorf("mqtt: create database %q: %s", t.Database, err)
+			}
+		}
+
+		batchers := make([]*tsdb.PointBatcher, writers)
+		for w := 0; w < writers; w++ {
+			batchers[w] = tsdb.NewPointBatcher(s.config.BatchSize, s.config.BatchPending, time.Duration(s.config.BatchTimeout))
+			batchers[w].Start()
+
+			s.wg.Add(1)
+			go s.writer(batchers[w], t.Database, t.RetentionPolicy)
+		}
+		s.destBatchers[key] = batchers
+	}
+	return nil
+}
+
+// clientOptions builds the Paho client options from the Config, including
+// TLS settings and the reconnect/subscribe handlers.
+func (s *Service) clientOptions() (*paho.ClientOptions, error) {
+	opts := paho.NewClientOptions()
+	for _, b := range s.config.Brokers {
+		opts.AddBroker(b)
+	}
+	opts.SetClientID(s.config.ClientID)
+	opts.SetUsername(s.config.Username)
+	opts.SetPassword(s.config.Password)
+	opts.SetCleanSession(s.config.CleanSession)
+	opts.SetKeepAlive(time.Duration(s.config.KeepAlive))
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(DefaultMaxConnectRetryInterval)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(time.Duration(s.config.ConnectRetryInterval))
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	opts.SetOnConnectHandler(s.onConnect)
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		atomic.AddInt64(&s.stats.ConnectionsActive, -1)
+		s.Logger.Error("Lost connection to mqtt broker, reconnecting", zap.Error(err))
+	})
+	opts.SetReconnectingHandler(func(_ paho.Client, _ *paho.ClientOptions) {
+		atomic.AddInt64(&s.stats.Reconnects, 1)
+	})
+
+	return opts, nil
+}
+
+func (s *Service) tlsConfig() (*tls.Config, error) {
+	if s.config.SSLCA == "" && s.config.SSLCert == "" {
+		if !s.config.InsecureSkipVerify {
+			return nil, nil
+		}
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: s.config.InsecureSkipVerify}
+
+	if s.config.SSLCA != "" {
+		pem, err := ioutil.ReadFile(s.config.SSLCA)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: read ssl-ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mqtt: unable to parse ssl-ca %q", s.config.SSLCA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if s.config.SSLCert != "" && s.config.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(s.config.SSLCert, s.config.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt: load ssl-cert/ssl-key: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// onConnect subscribes to the configured topics. It is called on initial
+// connect and on every automatic reconnect, since Paho does not remember
+// subscriptions across a broker-forced session reset.
+func (s *Service) onConnect(c paho.Client) {
+	atomic.AddInt64(&s.stats.ConnectionsActive, 1)
+
+	for i, t := range s.config.Topics {
+		topic, idx := t, i
+		handler := func(_ paho.Client, m paho.Message) {
+			s.handleMessage(topic, idx, m.Topic(), m.Payload())
+		}
+		if token := c.Subscribe(topic.Filter, topic.QoS, handler); token.Wait() && token.Error() != nil {
+			s.Logger.Error("Unable to subscribe to topic", zap.String("topic", topic.Filter), zap.Error(token.Error()))
+		}
+	}
+}
+
+// handleMessage parses an incoming MQTT payload into points and hands them
+// to the appropriate batcher. idx is this topic's position in config.Topics,
+// used to look up its template engine and route it to a batcher.
+func (s *Service) handleMessage(t Topic, idx int, topic string, payload []byte) {
+	atomic.AddInt64(&s.stats.BytesReceived, int64(len(payload)))
+
+	points, err := models.ParsePointsWithPrecision(payload, time.Now().UTC(), t.Precision)
+	if err != nil {
+		points, err = s.pointsFromTemplate(t, idx, topic, payload)
+		if err != nil {
+			atomic.AddInt64(&s.stats.PointsParseFail, 1)
+			s.Logger.Debug("Unable to parse mqtt payload", zap.String("topic", topic), zap.Error(err))
+			return
+		}
+	}
+
+	atomic.AddInt64(&s.stats.PointsReceived, int64(len(points)))
+
+	batchers := s.destBatchers[s.topicDest[idx]]
+	batcher := batchers[s.batcherIndex(topic, len(batchers))]
+	for _, p := range points {
+		batcher.In() <- p
+	}
+}
+
+// pointsFromTemplate builds a single point from a bare value payload using
+// the topic's template engine to resolve a measurement and tags from the
+// MQTT topic the message arrived on.
+func (s *Service) pointsFromTemplate(t Topic, idx int, topic string, payload []byte) ([]models.Point, error) {
+	engine := s.templates[idx]
+	if engine == nil {
+		return nil, fmt.Errorf("no template configured for topic %q", t.Filter)
+	}
+
+	value := strings.TrimSpace(string(payload))
+	if value == "" {
+		return nil, fmt.Errorf("empty payload on topic %q", topic)
+	}
+
+	measurement, tags, field, err := engine.Apply(topic)
+	if err != nil {
+		return nil, err
+	}
+	if field == "" {
+		field = "value"
+	}
+
+	p, err := models.NewPoint(measurement, models.NewTags(tags), models.Fields{field: value}, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return []models.Point{p}, nil
+}
+
+// batcherIndex selects which of a destination's batchers a topic's points
+// are routed to. Points for the same topic are always routed to the same
+// batcher so that ordering is preserved per series.
+func (s *Service) batcherIndex(topic string, numBatchers int) int {
+	if numBatchers == 1 {
+		return 0
+	}
+	h := fnv32(topic)
+	return int(h) % numBatchers
+}
+
+// destinationKey identifies the (database, retention-policy) pair a batch of
+// points is written to, used to key destBatchers so that points for
+// different destinations are never pooled into the same batch.
+func destinationKey(database, retentionPolicy string) string {
+	return database + "\x00" + retentionPolicy
+}
+
+func fnv32(s string) uint32 {
+	const prime32 = 16777619
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash *= prime32
+		hash ^= uint32(s[i])
+	}
+	return hash
+}
+
+// writer drains a single batcher and writes its batches to the PointsWriter,
+// always using the (database, retentionPolicy) destination it was started
+// for.
+func (s *Service) writer(batcher *tsdb.PointBatcher, database, retentionPolicy string) {
+	defer s.wg.Done()
+	for {
+		select {
+		case batch := <-batcher.Out():
+			s.writePoints(batch, database, retentionPolicy)
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func (s *Service) writePoints(points []models.Point, database, retentionPolicy string) {
+	if err := s.PointsWriter.WritePointsPrivileged(database, retentionPolicy, models.ConsistencyLevelAny, points); err != nil {
+		atomic.AddInt64(&s.stats.BatchesTransmitFail, 1)
+		s.Logger.Info("Failed to write point batch", zap.Error(err))
+		return
+	}
+
+	atomic.AddInt64(&s.stats.BatchesTransmitted, 1)
+	atomic.AddInt64(&s.stats.PointsTransmitted, int64(len(points)))
+}
+
+// Close disconnects from the broker(s) and stops all writer goroutines.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.client != nil && s.client.IsConnected() {
+		s.client.Disconnect(250)
+	}
+
+	close(s.closing)
+	for _, batchers := range s.destBatchers {
+		for _, b := range batchers {
+			b.Stop()
+		}
+	}
+	s.wg.Wait()
+
+	return nil
+}
+
+// WithLogger sets the logger for the service.
+func (s *Service) WithLogger(log *zap.Logger) {
+	s.Logger = log.With(zap.String("service", "mqtt"))
+}
+
+// Statistics returns statistics for periodic monitoring.
+func (s *Service) Statistics(tags map[string]string) []models.Statistic {
+	merged := s.defaultTags.Merge(tags)
+	return []models.Statistic{{
+		Name: "mqtt",
+		Tags: merged,
+		Values: map[string]interface{}{
+			statPointsReceived:      atomic.LoadInt64(&s.stats.PointsReceived),
+			statBytesReceived:       atomic.LoadInt64(&s.stats.BytesReceived),
+			statPointsParseFail:     atomic.LoadInt64(&s.stats.PointsParseFail),
+			statBatchesTransmitted:  atomic.LoadInt64(&s.stats.BatchesTransmitted),
+			statPointsTransmitted:   atomic.LoadInt64(&s.stats.PointsTransmitted),
+			statBatchesTransmitFail: atomic.LoadInt64(&s.stats.BatchesTransmitFail),
+			statConnectionsActive:   atomic.LoadInt64(&s.stats.ConnectionsActive),
+			statReconnects:          atomic.LoadInt64(&s.stats.Reconnects),
+		},
+	}}
+}
+
+// Diagnostics returns diagnostic information.
+func (s *Service) Diagnostics() (*diagnostics.Diagnostics, error) {
+	d := &diagnostics.Diagnostics{
+		Columns: []string{"brokers", "client-id", "database", "retention-policy", "topics"},
+		Rows: [][]interface{}{
+			{strings.Join(s.config.Brokers, ","), s.config.ClientID, s.config.Database, s.config.RetentionPolicy, len(s.config.Topics)},
+		},
+	}
+	return d, nil
+}
+
+// PrometheusCollectors satisfies the collector interface used by other
+// ingestion services so the MQTT service can be registered alongside them.
+func (s *Service) PrometheusCollectors() []prometheus.Collector {
+	return nil
+}
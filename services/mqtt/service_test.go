@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/pkg/template"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/toml"
+)
+
+// fakeMetaClient satisfies Service.MetaClient without creating anything.
+type fakeMetaClient struct{}
+
+func (fakeMetaClient) CreateDatabase(name string) (*meta.DatabaseInfo, error) { return nil, nil }
+
+// recordingWriter satisfies Service.PointsWriter and records every call, for
+// tests that need to observe what was ultimately written without a real
+// PointsWriter.
+type recordingWriter struct {
+	mu    sync.Mutex
+	calls []writeCall
+}
+
+type writeCall struct {
+	database        string
+	retentionPolicy string
+	points          []models.Point
+}
+
+func (w *recordingWriter) WritePointsPrivileged(database, retentionPolicy string, _ models.ConsistencyLevel, points []models.Point) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls = append(w.calls, writeCall{database: database, retentionPolicy: retentionPolicy, points: points})
+	return nil
+}
+
+func (w *recordingWriter) waitForCall(t *testing.T) writeCall {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		w.mu.Lock()
+		if len(w.calls) > 0 {
+			call := w.calls[0]
+			w.mu.Unlock()
+			return call
+		}
+		w.mu.Unlock()
+		select {
+		case <-deadline:
+			t.Fatal("PointsWriter never received a call")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestDestinationKey(t *testing.T) {
+	if destinationKey("a", "rp1") == destinationKey("a", "rp2") {
+		t.Error("destinationKey should differ when retention policy differs")
+	}
+	if destinationKey("a", "rp") == destinationKey("b", "rp") {
+		t.Error("destinationKey should differ when database differs")
+	}
+	if destinationKey("a", "rp") != destinationKey("a", "rp") {
+		t.Error("destinationKey should be stable for the same inputs")
+	}
+}
+
+// newTestService builds a Service with its destinations wired up the same
+// way Open does, but without touching the network (no broker connect).
+func newTestService(t *testing.T, cfg Config) (*Service, *recordingWriter) {
+	t.Helper()
+	s := NewService(cfg)
+	s.config = *s.config.WithDefaults()
+	s.MetaClient = fakeMetaClient{}
+
+	w := &recordingWriter{}
+	s.PointsWriter = w
+
+	s.templates = make([]*template.Engine, len(s.config.Topics))
+	for i, topic := range s.config.Topics {
+		if topic.Template == "" {
+			continue
+		}
+		e, err := template.NewEngine([]string{topic.Template}, "/")
+		if err != nil {
+			t.Fatalf("template.NewEngine(%q) returned error: %s", topic.Template, err)
+		}
+		s.templates[i] = e
+	}
+
+	if err := s.openDestinations(); err != nil {
+		t.Fatalf("openDestinations returned error: %s", err)
+	}
+	t.Cleanup(func() {
+		close(s.closing)
+		for _, batchers := range s.destBatchers {
+			for _, b := range batchers {
+				b.Stop()
+			}
+		}
+	})
+	return s, w
+}
+
+func TestService_OpenDestinations_GroupsTopicsByDatabase(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Database = "default"
+	cfg.Topics = []Topic{
+		{Filter: "a/#"},
+		{Filter: "b/#"},
+		{Filter: "c/#", Database: "other"},
+	}
+
+	s, _ := newTestService(t, cfg)
+
+	if s.topicDest[0] != s.topicDest[1] {
+		t.Errorf("topics with no per-topic override should share a destination: %q != %q", s.topicDest[0], s.topicDest[1])
+	}
+	if s.topicDest[0] == s.topicDest[2] {
+		t.Errorf("topic with an overridden database should route to a different destination")
+	}
+	if len(s.destBatchers) != 2 {
+		t.Errorf("got %d destination batcher pools, want 2", len(s.destBatchers))
+	}
+}
+
+// TestService_HandleMessage_AppliesTopicTemplateAndRoutesToDestination
+// exercises the Topic.Template doc-comment example end to end: a bare value
+// payload on a templated topic should resolve a measurement via pkg/template
+// and land at the topic's configured database/retention-policy.
+func TestService_HandleMessage_AppliesTopicTemplateAndRoutesToDestination(t *testing.T) {
+	cfg := NewConfig()
+	cfg.Database = "default"
+	cfg.RetentionPolicy = "autogen"
+	cfg.BatchSize = 1
+	cfg.BatchPending = 1
+	cfg.BatchTimeout = toml.Duration(time.Millisecond)
+	cfg.Topics = []Topic{
+		{Filter: "sensors/+", Template: "sensors measurement", Database: "sensors-db"},
+	}
+
+	s, w := newTestService(t, cfg)
+
+	s.handleMessage(s.config.Topics[0], 0, "sensors/temperature", []byte("21.5"))
+
+	call := w.waitForCall(t)
+	if call.database != "sensors-db" {
+		t.Errorf("database = %q, want %q", call.database, "sensors-db")
+	}
+	if call.retentionPolicy != "autogen" {
+		t.Errorf("retentionPolicy = %q, want %q", call.retentionPolicy, "autogen")
+	}
+	if len(call.points) != 1 || call.points[0].Name() != "temperature" {
+		t.Fatalf("got points %v, want a single point named %q", call.points, "temperature")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/influxdata/influxdb/monitor/diagnostics"
+	"github.com/influxdata/influxdb/pkg/template"
 	"github.com/influxdata/influxdb/toml"
 )
 
@@ -44,6 +45,10 @@ const (
 
 	// DefaultWriters is the default number of writers.
 	DefaultWriters = 1
+
+	// DefaultTemplateSeparator is the default delimiter used to split a
+	// datagram's key into parts when applying Templates.
+	DefaultTemplateSeparator = "."
 )
 
 // Config holds various configuration settings for the UDP listener.
@@ -59,6 +64,74 @@ type Config struct {
 	BatchTimeout    toml.Duration `toml:"batch-timeout"`
 	Precision       string        `toml:"precision"`
 	Writers         int           `toml:"writers"`
+
+	// Templates maps non-line-protocol datagrams into a measurement/tag/field
+	// layout, the same way the Graphite input does. Each entry is a
+	// "[filter] template [tags]" line; see pkg/template for the syntax. They
+	// are tried in order, so a catch-all template with no filter should
+	// typically be listed last.
+	Templates []string `toml:"templates"`
+
+	// TemplateSeparator is the delimiter used to split a datagram's key into
+	// parts before matching it against Templates. Defaults to ".".
+	TemplateSeparator string `toml:"template-separator"`
+
+	// Subscriptions forwards every accepted batch to a set of downstream
+	// sinks, in addition to writing it locally.
+	Subscriptions []Subscription `toml:"subscriptions"`
+}
+
+// SubscriptionMode controls how a Subscription's Destinations are used.
+type SubscriptionMode string
+
+const (
+	// SubscriptionModeAll sends every batch to every destination.
+	SubscriptionModeAll SubscriptionMode = "ALL"
+
+	// SubscriptionModeAny sends every batch to exactly one destination,
+	// chosen at random.
+	SubscriptionModeAny SubscriptionMode = "ANY"
+
+	// DefaultSubscriptionQueueSize is the default number of batches a
+	// destination's async queue will hold before applying DropPolicy.
+	DefaultSubscriptionQueueSize = 1000
+
+	// DefaultSubscriptionDropPolicy is applied when a destination's queue is
+	// full: the oldest queued batch is dropped to make room for the new one.
+	DefaultSubscriptionDropPolicy = "drop"
+)
+
+// Subscription configures a set of sinks that accepted batches are forwarded
+// to. Destinations are URLs whose scheme selects the Sink implementation:
+// "http"/"https" for another InfluxDB HTTP endpoint, "kafka" for a Kafka
+// topic, "mqtt"/"mqtts" for an MQTT broker, and "webhook+http"/"webhook+https"
+// for a generic HTTP webhook.
+type Subscription struct {
+	Mode         string   `toml:"mode"`
+	Destinations []string `toml:"destinations"`
+
+	// QueueSize bounds the number of batches buffered per destination before
+	// DropPolicy applies. Defaults to DefaultSubscriptionQueueSize.
+	QueueSize int `toml:"queue-size"`
+
+	// DropPolicy is "drop" (discard the oldest queued batch to admit the new
+	// one) or "block" (apply backpressure to ingestion until the queue has
+	// room). Defaults to "drop" so a slow sink cannot stall ingestion.
+	DropPolicy string `toml:"drop-policy"`
+}
+
+// WithDefaults returns a copy of the Subscription with defaults applied.
+func (s Subscription) WithDefaults() Subscription {
+	if s.QueueSize == 0 {
+		s.QueueSize = DefaultSubscriptionQueueSize
+	}
+	if s.DropPolicy == "" {
+		s.DropPolicy = DefaultSubscriptionDropPolicy
+	}
+	if s.Mode == "" {
+		s.Mode = string(SubscriptionModeAll)
+	}
+	return s
 }
 
 // NewConfig returns a new instance of Config with defaults.
@@ -99,9 +172,21 @@ func (c *Config) WithDefaults() *Config {
 	if d.Writers == 0 {
 		d.Writers = DefaultWriters
 	}
+	if d.TemplateSeparator == "" {
+		d.TemplateSeparator = DefaultTemplateSeparator
+	}
 	return &d
 }
 
+// TemplateEngine builds the template.Engine described by Templates and
+// TemplateSeparator. It returns nil, nil if no Templates are configured.
+func (c *Config) TemplateEngine() (*template.Engine, error) {
+	if len(c.Templates) == 0 {
+		return nil, nil
+	}
+	return template.NewEngine(c.Templates, c.TemplateSeparator)
+}
+
 // Configs wraps a slice of Config to aggregate diagnostics.
 type Configs []Config
 
@@ -0,0 +1,41 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+// reusePortSupported is false on platforms without SO_REUSEPORT, such as
+// Windows; the service falls back to a single socket with in-process
+// fan-out across Writers goroutines in that case.
+const reusePortSupported = false
+
+func listenReusePort(addr string) (*net.UDPConn, error) {
+	return nil, errors.New("udp: SO_REUSEPORT is not supported on this platform")
+}
+
+// singleBatchReader reads one datagram per ReadBatch call. It is used on
+// platforms with no batched-receive syscall available.
+type singleBatchReader struct {
+	conn *net.UDPConn
+	buf  []byte
+	out  [1][]byte
+}
+
+// newBatchReader returns the platform's batched-read implementation for
+// conn.
+func newBatchReader(conn *net.UDPConn) batchReader {
+	return &singleBatchReader{conn: conn, buf: make([]byte, udpBufferSize)}
+}
+
+func (r *singleBatchReader) ReadBatch() ([][]byte, error) {
+	n, _, err := r.conn.ReadFromUDP(r.buf)
+	if err != nil {
+		return nil, err
+	}
+	r.out[0] = r.buf[:n]
+	return r.out[:], nil
+}
@@ -0,0 +1,74 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package udp
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported is true on platforms where SO_REUSEPORT lets multiple
+// sockets bind the same address, with the kernel load-balancing datagrams
+// across them.
+const reusePortSupported = true
+
+// listenReusePort opens a new UDP socket bound to addr with SO_REUSEPORT
+// set. Called once per writer, this lets Writers sockets share a single
+// BindAddress instead of funneling every datagram through one socket.
+func listenReusePort(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// reusePortBatchReader reads datagrams in batches using recvmmsg, via
+// golang.org/x/net/ipv4, instead of one syscall per datagram.
+type reusePortBatchReader struct {
+	pc   *ipv4.PacketConn
+	msgs []ipv4.Message
+	out  [][]byte
+}
+
+// newBatchReader returns the platform's batched-read implementation for
+// conn.
+func newBatchReader(conn *net.UDPConn) batchReader {
+	msgs := make([]ipv4.Message, readBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, udpBufferSize)}
+	}
+	return &reusePortBatchReader{
+		pc:   ipv4.NewPacketConn(conn),
+		msgs: msgs,
+		out:  make([][]byte, readBatchSize),
+	}
+}
+
+func (r *reusePortBatchReader) ReadBatch() ([][]byte, error) {
+	n, err := r.pc.ReadBatch(r.msgs, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		r.out[i] = r.msgs[i].Buffers[0][:r.msgs[i].N]
+	}
+	return r.out[:n], nil
+}
@@ -0,0 +1,571 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxdb/monitor/diagnostics"
+	"github.com/influxdata/influxdb/pkg/template"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/influxdata/influxdb/tsdb"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// udpBufferSize is the largest datagram accepted from a socket.
+	udpBufferSize = 65536
+
+	// readBatchSize is the number of datagrams requested per batched-receive
+	// syscall, on platforms that support one. It has no effect where the
+	// fallback single-read batchReader is used.
+	readBatchSize = 32
+
+	// fanOutQueueSize sizes the channel used to hand raw datagrams from the
+	// single socket reader to the writer pool on platforms without
+	// SO_REUSEPORT.
+	fanOutQueueSize = 4096
+
+	// statPointsReceived and friends are keys into the Statistics map
+	// returned from Service.Statistics.
+	statPointsReceived      = "pointsRx"
+	statBytesReceived       = "bytesRx"
+	statPointsParseFail     = "pointsParseFail"
+	statReadFail            = "readFail"
+	statBatchesTransmitted  = "batchesTx"
+	statPointsTransmitted   = "pointsTx"
+	statBatchesTransmitFail = "batchesTxFail"
+)
+
+// Service represents a UDP service for ingesting line-protocol data. When
+// Config.Writers is greater than one, it shards the receive path across
+// Writers sockets (via SO_REUSEPORT, where supported) and Writers batchers,
+// hashing points to a batcher by measurement so per-series ordering is
+// preserved regardless of which socket or goroutine received them.
+type Service struct {
+	conn *net.UDPConn // the single listener in non-reuseport mode, or writer 0's socket in reuseport mode; used by Addr() and closed by Close
+	addr *net.UDPAddr
+	wg   sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+
+	writers []*writerPipeline
+	fanOut  chan []byte // only used when Writers > 1 and SO_REUSEPORT is unsupported
+
+	config     Config
+	templates  *template.Engine
+	subscriber *subscriber
+
+	PointsWriter interface {
+		WritePointsPrivileged(database, retentionPolicy string, consistencyLevel models.ConsistencyLevel, points []models.Point) error
+	}
+
+	MetaClient interface {
+		CreateDatabase(name string) (*meta.DatabaseInfo, error)
+	}
+
+	Logger      *zap.Logger
+	stats       Statistics
+	defaultTags models.StatisticTags
+}
+
+// writerPipeline is the per-writer receive-and-batch pipeline: a socket (in
+// SO_REUSEPORT mode) or a fan-out consumer (otherwise), a dedicated
+// tsdb.PointBatcher, and that writer's own statistics.
+type writerPipeline struct {
+	id      int
+	conn    *net.UDPConn // nil in fan-out mode; set by Open and closed by Close
+	batcher *tsdb.PointBatcher
+	stats   WriterStatistics
+}
+
+// WriterStatistics tracks per-writer statistics for the sharded UDP receive
+// pipeline.
+type WriterStatistics struct {
+	PacketsReceived int64
+	BytesReceived   int64
+	ParseErrors     int64
+	BatchesFlushed  int64
+}
+
+// Statistics tracks statistics for the UDP service.
+type Statistics struct {
+	PointsReceived      int64
+	BytesReceived       int64
+	PointsParseFail     int64
+	ReadFail            int64
+	BatchesTransmitted  int64
+	PointsTransmitted   int64
+	BatchesTransmitFail int64
+}
+
+// NewService returns a new instance of Service.
+func NewService(c Config) *Service {
+	d := c.WithDefaults()
+	return &Service{
+		config:      *d,
+		Logger:      zap.NewNop(),
+		defaultTags: models.StatisticTags{"bind": d.BindAddress},
+	}
+}
+
+// Open starts the service.
+func (s *Service) Open() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.PointsWriter == nil {
+		return fmt.Errorf("udp: WritePointsPrivileged is nil")
+	}
+
+	if s.templates, err = s.config.TemplateEngine(); err != nil {
+		return fmt.Errorf("udp: invalid templates: %s", err)
+	}
+
+	if s.subscriber, err = newSubscriber(s.config.Subscriptions, s.Logger); err != nil {
+		return fmt.Errorf("udp: invalid subscriptions: %s", err)
+	}
+
+	if db := s.config.Database; db != "" {
+		if _, err := s.MetaClient.CreateDatabase(db); err != nil {
+			return fmt.Errorf("udp: create database %q: %s", db, err)
+		}
+	}
+
+	s.addr, err = net.ResolveUDPAddr("udp", s.config.BindAddress)
+	if err != nil {
+		return fmt.Errorf("udp: resolve address: %s", err)
+	}
+
+	numWriters := s.config.Writers
+	if numWriters < 1 {
+		numWriters = 1
+	}
+
+	s.writers = make([]*writerPipeline, numWriters)
+	for i := range s.writers {
+		w := &writerPipeline{
+			id:      i,
+			batcher: tsdb.NewPointBatcher(s.config.BatchSize, s.config.BatchPending, time.Duration(s.config.BatchTimeout)),
+		}
+		w.batcher.Start()
+		s.writers[i] = w
+
+		s.wg.Add(1)
+		go s.flush(w)
+	}
+
+	switch {
+	case numWriters > 1 && reusePortSupported:
+		if err := s.openReusePort(numWriters); err != nil {
+			return err
+		}
+		s.Logger.Info("Listening on UDP with SO_REUSEPORT",
+			zap.Stringer("addr", s.conn.LocalAddr()), zap.Int("writers", numWriters))
+
+	case numWriters > 1:
+		if err := s.openFanOut(numWriters); err != nil {
+			return err
+		}
+		s.Logger.Info("SO_REUSEPORT is not supported on this platform; falling back to a single socket with in-process fan-out",
+			zap.Stringer("addr", s.conn.LocalAddr()), zap.Int("writers", numWriters))
+
+	default:
+		conn, err := s.listen(s.config.BindAddress)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		s.writers[0].conn = conn
+
+		s.wg.Add(1)
+		go s.readLoop(s.writers[0], newBatchReader(conn))
+
+		s.Logger.Info("Listening on UDP", zap.Stringer("addr", conn.LocalAddr()))
+	}
+
+	return nil
+}
+
+// listen opens a single, non-SO_REUSEPORT UDP socket, applying ReadBuffer.
+func (s *Service) listen(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("udp: resolve address: %s", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("udp: listen: %s", err)
+	}
+	s.applyReadBuffer(conn)
+	return conn, nil
+}
+
+func (s *Service) applyReadBuffer(conn *net.UDPConn) {
+	if s.config.ReadBuffer == 0 {
+		return
+	}
+	if err := conn.SetReadBuffer(s.config.ReadBuffer); err != nil {
+		s.Logger.Info("Unable to set UDP read buffer", zap.Int("size", s.config.ReadBuffer), zap.Error(err))
+	}
+}
+
+// openReusePort binds one socket per writer to the same address using
+// SO_REUSEPORT, so the kernel load-balances incoming datagrams across them,
+// and starts one dedicated reader goroutine per socket.
+func (s *Service) openReusePort(numWriters int) error {
+	for i := 0; i < numWriters; i++ {
+		conn, err := listenReusePort(s.config.BindAddress)
+		if err != nil {
+			return fmt.Errorf("udp: listen (SO_REUSEPORT, writer %d): %s", i, err)
+		}
+		s.applyReadBuffer(conn)
+		s.writers[i].conn = conn
+		if i == 0 {
+			s.conn = conn
+		}
+
+		s.wg.Add(1)
+		go s.readLoop(s.writers[i], newBatchReader(conn))
+	}
+	return nil
+}
+
+// openFanOut binds a single socket and fans its datagrams out to numWriters
+// parser goroutines over a bounded channel, so parsing still scales across
+// CPUs even though the kernel cannot shard the receive queue itself.
+func (s *Service) openFanOut(numWriters int) error {
+	conn, err := s.listen(s.config.BindAddress)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.fanOut = make(chan []byte, fanOutQueueSize)
+
+	s.wg.Add(1)
+	go s.readRawDatagrams(conn)
+
+	for i := 0; i < numWriters; i++ {
+		s.wg.Add(1)
+		go s.readLoop(s.writers[i], &chanBatchReader{ch: s.fanOut})
+	}
+	return nil
+}
+
+// readRawDatagrams reads off the single socket in fan-out mode and forwards
+// a copy of each datagram to the fan-out channel for a writer to parse.
+func (s *Service) readRawDatagrams(conn *net.UDPConn) {
+	defer s.wg.Done()
+	defer close(s.fanOut)
+
+	br := newBatchReader(conn)
+	for {
+		datagrams, err := br.ReadBatch()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			atomic.AddInt64(&s.stats.ReadFail, 1)
+			s.Logger.Info("Failed to read UDP message", zap.Error(err))
+			continue
+		}
+		for _, d := range datagrams {
+			cp := make([]byte, len(d))
+			copy(cp, d)
+			s.fanOut <- cp
+		}
+	}
+}
+
+// readLoop pulls datagrams from br, parses them into points, and hashes each
+// point to a writer's batcher by measurement so that all points for a given
+// series are always handled by the same batcher. w identifies which writer
+// owns the socket or fan-out consumer this goroutine is reading from, for
+// per-writer receive statistics; it is not necessarily the batcher that ends
+// up receiving any given point.
+func (s *Service) readLoop(w *writerPipeline, br batchReader) {
+	defer s.wg.Done()
+
+	for {
+		datagrams, err := br.ReadBatch()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			atomic.AddInt64(&s.stats.ReadFail, 1)
+			s.Logger.Info("Failed to read UDP message", zap.Error(err))
+			continue
+		}
+
+		for _, payload := range datagrams {
+			atomic.AddInt64(&w.stats.PacketsReceived, 1)
+			atomic.AddInt64(&w.stats.BytesReceived, int64(len(payload)))
+			atomic.AddInt64(&s.stats.BytesReceived, int64(len(payload)))
+			s.handleDatagram(w, payload)
+		}
+	}
+}
+
+func (s *Service) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// handleDatagram parses a single datagram, falling back to the template
+// engine (if configured) when the payload is not valid line protocol, then
+// routes each resulting point to the writer whose batcher owns its
+// measurement. payload is copied before parsing because the parsed points
+// are handed off to a batcher over a channel and written asynchronously by a
+// separate flush goroutine, by which time a batchReader backed by reused
+// buffers (e.g. reusePortBatchReader) may have overwritten it.
+func (s *Service) handleDatagram(w *writerPipeline, payload []byte) {
+	cp := make([]byte, len(payload))
+	copy(cp, payload)
+	payload = cp
+
+	points, err := models.ParsePointsWithPrecision(payload, time.Now().UTC(), s.config.Precision)
+	if err != nil {
+		points, err = s.pointsFromTemplate(payload)
+		if err != nil {
+			atomic.AddInt64(&w.stats.ParseErrors, 1)
+			atomic.AddInt64(&s.stats.PointsParseFail, 1)
+			s.Logger.Debug("Failed to parse UDP datagram", zap.Error(err))
+			return
+		}
+	}
+
+	atomic.AddInt64(&s.stats.PointsReceived, int64(len(points)))
+	for _, p := range points {
+		s.writerFor(p).batcher.In() <- p
+	}
+}
+
+// writerFor returns the writer whose batcher owns p, selected by hashing
+// its measurement name so that every point for a given series is always
+// routed to the same batcher, preserving per-series order.
+func (s *Service) writerFor(p models.Point) *writerPipeline {
+	if len(s.writers) == 1 {
+		return s.writers[0]
+	}
+	h := hashString(p.Name())
+	return s.writers[h%uint32(len(s.writers))]
+}
+
+// batchReader abstracts a (possibly batched) datagram read so readLoop does
+// not need to know whether it is backed by a real socket using recvmmsg-
+// style batched syscalls, a single ReadFromUDP per call, or the in-process
+// fan-out channel used when SO_REUSEPORT is unavailable. The returned
+// slices are only valid until the next call to ReadBatch.
+type batchReader interface {
+	ReadBatch() ([][]byte, error)
+}
+
+// chanBatchReader adapts the fan-out channel fed by readRawDatagrams to the
+// batchReader interface so readLoop can treat it like any other source.
+type chanBatchReader struct {
+	ch chan []byte
+}
+
+func (r *chanBatchReader) ReadBatch() ([][]byte, error) {
+	d, ok := <-r.ch
+	if !ok {
+		return nil, fmt.Errorf("udp: fan-out channel closed")
+	}
+	return [][]byte{d}, nil
+}
+
+// hashString is an FNV-1a hash used to shard points across writers.
+func hashString(s string) uint32 {
+	const offsetBasis, prime = uint32(2166136261), uint32(16777619)
+	h := offsetBasis
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= prime
+	}
+	return h
+}
+
+// pointsFromTemplate applies the template engine to a bare "key value"
+// datagram, where key is delimited by the configured TemplateSeparator.
+func (s *Service) pointsFromTemplate(payload []byte) ([]models.Point, error) {
+	if s.templates == nil {
+		return nil, fmt.Errorf("payload is not line protocol and no templates are configured")
+	}
+
+	line := strings.TrimSpace(string(payload))
+	key, value, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, fmt.Errorf("expected 'key value', got %q", line)
+	}
+
+	measurement, tags, field, err := s.templates.Apply(key)
+	if err != nil {
+		return nil, err
+	}
+	if field == "" {
+		field = "value"
+	}
+
+	p, err := models.NewPoint(measurement, models.NewTags(tags), models.Fields{field: strings.TrimSpace(value)}, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	return []models.Point{p}, nil
+}
+
+// flush drains w's batcher and writes batches to the PointsWriter.
+func (s *Service) flush(w *writerPipeline) {
+	defer s.wg.Done()
+	for batch := range w.batcher.Out() {
+		if err := s.PointsWriter.WritePointsPrivileged(s.config.Database, s.config.RetentionPolicy, models.ConsistencyLevelAny, batch); err != nil {
+			atomic.AddInt64(&s.stats.BatchesTransmitFail, 1)
+			s.Logger.Info("Failed to write point batch", zap.Error(err))
+			continue
+		}
+		atomic.AddInt64(&w.stats.BatchesFlushed, 1)
+		atomic.AddInt64(&s.stats.BatchesTransmitted, 1)
+		atomic.AddInt64(&s.stats.PointsTransmitted, int64(len(batch)))
+
+		s.subscriber.Send(s.config.Database, s.config.RetentionPolicy, batch)
+	}
+}
+
+// Close closes the underlying socket(s) and stops the service's goroutines.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	closedConns := make(map[*net.UDPConn]bool)
+	for _, w := range s.writers {
+		if w.conn != nil && !closedConns[w.conn] {
+			w.conn.Close()
+			closedConns[w.conn] = true
+		}
+	}
+	if s.conn != nil && !closedConns[s.conn] {
+		s.conn.Close()
+	}
+	for _, w := range s.writers {
+		w.batcher.Stop()
+	}
+	s.subscriber.Close()
+	s.wg.Wait()
+
+	return nil
+}
+
+// Addr returns the listener's address. Returns nil if not open.
+func (s *Service) Addr() net.Addr {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// WithLogger sets the logger for the service.
+func (s *Service) WithLogger(log *zap.Logger) {
+	s.Logger = log.With(zap.String("service", "udp"))
+}
+
+// Statistics returns statistics for periodic monitoring, including one
+// per-writer row for the sharded receive pipeline.
+func (s *Service) Statistics(tags map[string]string) []models.Statistic {
+	merged := s.defaultTags.Merge(tags)
+	stats := []models.Statistic{{
+		Name: "udp",
+		Tags: merged,
+		Values: map[string]interface{}{
+			statPointsReceived:      atomic.LoadInt64(&s.stats.PointsReceived),
+			statBytesReceived:       atomic.LoadInt64(&s.stats.BytesReceived),
+			statPointsParseFail:     atomic.LoadInt64(&s.stats.PointsParseFail),
+			statReadFail:            atomic.LoadInt64(&s.stats.ReadFail),
+			statBatchesTransmitted:  atomic.LoadInt64(&s.stats.BatchesTransmitted),
+			statPointsTransmitted:   atomic.LoadInt64(&s.stats.PointsTransmitted),
+			statBatchesTransmitFail: atomic.LoadInt64(&s.stats.BatchesTransmitFail),
+		},
+	}}
+
+	for _, w := range s.writers {
+		writerTags := make(map[string]string, len(merged)+1)
+		for k, v := range merged {
+			writerTags[k] = v
+		}
+		writerTags["writer"] = fmt.Sprint(w.id)
+
+		stats = append(stats, models.Statistic{
+			Name: "udp_writer",
+			Tags: writerTags,
+			Values: map[string]interface{}{
+				"packetsRx":      atomic.LoadInt64(&w.stats.PacketsReceived),
+				"bytesRx":        atomic.LoadInt64(&w.stats.BytesReceived),
+				"parseErrors":    atomic.LoadInt64(&w.stats.ParseErrors),
+				"batchesFlushed": atomic.LoadInt64(&w.stats.BatchesFlushed),
+			},
+		})
+	}
+
+	return stats
+}
+
+// Diagnostics returns diagnostic information, including one row per writer
+// in the sharded receive pipeline.
+func (s *Service) Diagnostics() (*diagnostics.Diagnostics, error) {
+	d := &diagnostics.Diagnostics{
+		Columns: []string{"writer", "bind-address", "database", "retention-policy", "templates", "writers", "reuse-port", "packets-received", "bytes-received", "parse-errors", "batches-flushed"},
+	}
+	for _, w := range s.writers {
+		d.AddRow([]interface{}{
+			w.id,
+			s.config.BindAddress,
+			s.config.Database,
+			s.config.RetentionPolicy,
+			len(s.config.Templates),
+			len(s.writers),
+			len(s.writers) > 1 && reusePortSupported,
+			atomic.LoadInt64(&w.stats.PacketsReceived),
+			atomic.LoadInt64(&w.stats.BytesReceived),
+			atomic.LoadInt64(&w.stats.ParseErrors),
+			atomic.LoadInt64(&w.stats.BatchesFlushed),
+		})
+	}
+	return d, nil
+}
+
+// PrometheusCollectors returns the forwarded/dropped/failed points counters
+// for every configured subscription destination, plus the per-writer
+// packets/bytes/parse-errors/batches-flushed counters for the sharded
+// receive pipeline.
+func (s *Service) PrometheusCollectors() []prometheus.Collector {
+	collectors := s.subscriber.PrometheusCollectors()
+	for _, w := range s.writers {
+		w := w
+		labels := prometheus.Labels{"writer": fmt.Sprint(w.id)}
+		collectors = append(collectors,
+			prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "influxdb_udp_writer_packets_received_total", ConstLabels: labels}, func() float64 {
+				return float64(atomic.LoadInt64(&w.stats.PacketsReceived))
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "influxdb_udp_writer_bytes_received_total", ConstLabels: labels}, func() float64 {
+				return float64(atomic.LoadInt64(&w.stats.BytesReceived))
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "influxdb_udp_writer_parse_errors_total", ConstLabels: labels}, func() float64 {
+				return float64(atomic.LoadInt64(&w.stats.ParseErrors))
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{Name: "influxdb_udp_writer_batches_flushed_total", ConstLabels: labels}, func() float64 {
+				return float64(atomic.LoadInt64(&w.stats.BatchesFlushed))
+			}),
+		)
+	}
+	return collectors
+}
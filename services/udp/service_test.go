@@ -0,0 +1,46 @@
+package udp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func newTestPoint(t *testing.T, measurement string) models.Point {
+	t.Helper()
+	p, err := models.NewPoint(measurement, models.NewTags(nil), models.Fields{"value": 1.0}, time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("models.NewPoint(%q) returned error: %s", measurement, err)
+	}
+	return p
+}
+
+func TestService_WriterFor_HashesByMeasurement(t *testing.T) {
+	s := &Service{writers: []*writerPipeline{{id: 0}, {id: 1}, {id: 2}}}
+
+	p := newTestPoint(t, "cpu")
+	first := s.writerFor(p)
+	for i := 0; i < 10; i++ {
+		if got := s.writerFor(p); got != first {
+			t.Fatalf("writerFor(%q) returned a different writer on call %d: %v != %v", p.Name(), i, got, first)
+		}
+	}
+
+	names := []string{"cpu", "mem", "disk", "net", "swap", "io"}
+	seen := make(map[*writerPipeline]bool)
+	for _, name := range names {
+		seen[s.writerFor(newTestPoint(t, name))] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("writerFor spread %d distinct measurement names across only %d of %d writers", len(names), len(seen), len(s.writers))
+	}
+}
+
+func TestService_WriterFor_SingleWriter(t *testing.T) {
+	w := &writerPipeline{id: 0}
+	s := &Service{writers: []*writerPipeline{w}}
+	if got := s.writerFor(newTestPoint(t, "anything")); got != w {
+		t.Errorf("writerFor with one writer returned %v, want the only writer %v", got, w)
+	}
+}
@@ -0,0 +1,397 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+)
+
+// sinkHTTPTimeout bounds a single WritePoints call to an HTTP-based sink
+// (httpSink, webhookSink) or an MQTT connect/publish round trip.
+const sinkHTTPTimeout = 10 * time.Second
+
+// Sink is implemented by anything the points-writer path can forward
+// accepted batches to, in addition to writing them locally. It is
+// deliberately narrow so that HTTP, Kafka, MQTT, and webhook destinations
+// can all satisfy it.
+type Sink interface {
+	WritePoints(ctx context.Context, database, retentionPolicy string, points []models.Point) error
+}
+
+// NewSink builds the Sink appropriate for dest's URL scheme.
+func NewSink(dest string) (Sink, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, fmt.Errorf("udp: invalid subscription destination %q: %s", dest, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return &httpSink{addr: dest, client: &http.Client{Timeout: sinkHTTPTimeout}}, nil
+	case "kafka":
+		topic := strings.TrimPrefix(u.Path, "/")
+		if topic == "" {
+			return nil, fmt.Errorf("udp: kafka subscription destination %q is missing a topic path", dest)
+		}
+		return &kafkaSink{
+			topic: topic,
+			writer: &kafka.Writer{
+				Addr:     kafka.TCP(u.Host),
+				Topic:    topic,
+				Balancer: &kafka.LeastBytes{},
+			},
+		}, nil
+	case "mqtt", "mqtts":
+		topic := strings.TrimPrefix(u.Path, "/")
+		if topic == "" {
+			return nil, fmt.Errorf("udp: mqtt subscription destination %q is missing a topic path", dest)
+		}
+		return &mqttSink{broker: u.Scheme + "://" + u.Host, topic: topic}, nil
+	case "webhook+http", "webhook+https":
+		return &webhookSink{url: "http" + dest[len("webhook+http"):], client: &http.Client{Timeout: sinkHTTPTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("udp: unsupported subscription destination scheme %q", u.Scheme)
+	}
+}
+
+// lineProtocolOf encodes points as newline-delimited line protocol, the wire
+// format every Sink forwards downstream.
+func lineProtocolOf(points []models.Point) []byte {
+	var buf bytes.Buffer
+	for _, p := range points {
+		buf.WriteString(p.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// httpSink forwards points to another InfluxDB HTTP /write endpoint.
+type httpSink struct {
+	addr   string
+	client *http.Client
+}
+
+func (s *httpSink) WritePoints(ctx context.Context, database, retentionPolicy string, points []models.Point) error {
+	u := s.addr + "/write?" + url.Values{"db": {database}, "rp": {retentionPolicy}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(lineProtocolOf(points)))
+	if err != nil {
+		return fmt.Errorf("udp: build request for %q: %s", s.addr, err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("udp: write to %q: %s", s.addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("udp: write to %q: unexpected status %s", s.addr, resp.Status)
+	}
+	return nil
+}
+
+// kafkaSink forwards points, encoded as line protocol, to a Kafka topic.
+type kafkaSink struct {
+	topic  string
+	writer *kafka.Writer
+}
+
+func (s *kafkaSink) WritePoints(ctx context.Context, database, retentionPolicy string, points []models.Point) error {
+	if err := s.writer.WriteMessages(ctx, kafka.Message{Value: lineProtocolOf(points)}); err != nil {
+		return fmt.Errorf("udp: write to kafka topic %q: %s", s.topic, err)
+	}
+	return nil
+}
+
+func (s *kafkaSink) Close() error { return s.writer.Close() }
+
+// mqttSink forwards points, encoded as line protocol, to an MQTT broker. The
+// client connects lazily on first use and is reused across calls.
+type mqttSink struct {
+	broker string
+	topic  string
+
+	mu     sync.Mutex
+	client paho.Client
+}
+
+func (s *mqttSink) WritePoints(ctx context.Context, database, retentionPolicy string, points []models.Point) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	token := client.Publish(s.topic, 0, false, lineProtocolOf(points))
+	if !token.WaitTimeout(sinkHTTPTimeout) {
+		return fmt.Errorf("udp: publish to mqtt topic %q: timed out", s.topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("udp: publish to mqtt topic %q: %s", s.topic, err)
+	}
+	return nil
+}
+
+func (s *mqttSink) connect() (paho.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil && s.client.IsConnected() {
+		return s.client, nil
+	}
+
+	client := paho.NewClient(paho.NewClientOptions().AddBroker(s.broker))
+	if token := client.Connect(); !token.WaitTimeout(sinkHTTPTimeout) || token.Error() != nil {
+		return nil, fmt.Errorf("udp: connect to mqtt broker %q: %s", s.broker, token.Error())
+	}
+	s.client = client
+	return client, nil
+}
+
+func (s *mqttSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil && s.client.IsConnected() {
+		s.client.Disconnect(250)
+	}
+	return nil
+}
+
+// webhookSink POSTs points, encoded as line protocol, to an arbitrary HTTP
+// endpoint.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) WritePoints(ctx context.Context, database, retentionPolicy string, points []models.Point) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(lineProtocolOf(points)))
+	if err != nil {
+		return fmt.Errorf("udp: build request for webhook %q: %s", s.url, err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("udp: post to webhook %q: %s", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("udp: post to webhook %q: unexpected status %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// subscriptionStats are the Prometheus counters for a single destination.
+type subscriptionStats struct {
+	forwarded prometheus.Counter
+	dropped   prometheus.Counter
+	failed    prometheus.Counter
+}
+
+// pointBatch is a batch of points together with the database and retention
+// policy it was written to locally, so a Sink can forward it to the same
+// destination instead of an empty one.
+type pointBatch struct {
+	database        string
+	retentionPolicy string
+	points          []models.Point
+}
+
+// destination pairs a Sink with the bounded async queue that feeds it.
+type destination struct {
+	dest  string
+	sink  Sink
+	queue chan pointBatch
+	block bool
+	stats subscriptionStats
+	wg    sync.WaitGroup
+}
+
+// subscriber fans accepted batches out to the sinks described by the
+// configured Subscriptions. A slow or unreachable sink only affects its own
+// bounded queue; it never blocks ingestion unless that destination was
+// explicitly configured with DropPolicy "block".
+type subscriber struct {
+	subs []Subscription
+	dest map[string]*destination // keyed by destination string, for O(1) lookup
+
+	destinations []*destination
+	closing      chan struct{}
+
+	Logger *zap.Logger
+}
+
+// newSubscriber builds a subscriber from subs. It returns a nil subscriber
+// (not an error) if no subscriptions are configured.
+func newSubscriber(subs []Subscription, logger *zap.Logger) (*subscriber, error) {
+	if len(subs) == 0 {
+		return nil, nil
+	}
+
+	s := &subscriber{
+		subs:    make([]Subscription, len(subs)),
+		dest:    make(map[string]*destination),
+		closing: make(chan struct{}),
+		Logger:  logger,
+	}
+
+	for i, sub := range subs {
+		sub = sub.WithDefaults()
+		s.subs[i] = sub
+
+		if sub.Mode != string(SubscriptionModeAll) && sub.Mode != string(SubscriptionModeAny) {
+			return nil, fmt.Errorf("udp: invalid subscription mode %q", sub.Mode)
+		}
+
+		for _, d := range sub.Destinations {
+			if s.dest[d] != nil {
+				continue
+			}
+			sink, err := NewSink(d)
+			if err != nil {
+				return nil, err
+			}
+			dst := &destination{
+				dest:  d,
+				sink:  sink,
+				queue: make(chan pointBatch, sub.QueueSize),
+				block: sub.DropPolicy == "block",
+				stats: subscriptionStats{
+					forwarded: prometheus.NewCounter(prometheus.CounterOpts{Name: "influxdb_udp_subscription_points_forwarded_total", ConstLabels: prometheus.Labels{"destination": d}}),
+					dropped:   prometheus.NewCounter(prometheus.CounterOpts{Name: "influxdb_udp_subscription_points_dropped_total", ConstLabels: prometheus.Labels{"destination": d}}),
+					failed:    prometheus.NewCounter(prometheus.CounterOpts{Name: "influxdb_udp_subscription_points_failed_total", ConstLabels: prometheus.Labels{"destination": d}}),
+				},
+			}
+			s.dest[d] = dst
+			s.destinations = append(s.destinations, dst)
+		}
+	}
+
+	for _, dst := range s.destinations {
+		dst.wg.Add(1)
+		go s.drain(dst)
+	}
+
+	return s, nil
+}
+
+// drain is the per-destination goroutine that hands queued batches to the
+// destination's Sink.
+func (s *subscriber) drain(dst *destination) {
+	defer dst.wg.Done()
+	for {
+		select {
+		case batch := <-dst.queue:
+			if err := dst.sink.WritePoints(context.Background(), batch.database, batch.retentionPolicy, batch.points); err != nil {
+				dst.stats.failed.Add(float64(len(batch.points)))
+				s.Logger.Info("Failed to forward points to subscription destination", zap.String("destination", dst.dest), zap.Error(err))
+				continue
+			}
+			dst.stats.forwarded.Add(float64(len(batch.points)))
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// Send forwards points to every destination configured by the Subscriptions,
+// applying each Subscription's Mode independently. database/retentionPolicy
+// are the destination the points were written to locally, and are forwarded
+// unchanged so each Sink writes to the same destination.
+func (s *subscriber) Send(database, retentionPolicy string, points []models.Point) {
+	if s == nil {
+		return
+	}
+
+	batch := pointBatch{database: database, retentionPolicy: retentionPolicy, points: points}
+	for _, sub := range s.subs {
+		targets := s.destinationsFor(sub)
+		if len(targets) == 0 {
+			continue
+		}
+		if sub.Mode == string(SubscriptionModeAny) {
+			targets = targets[rand.Intn(len(targets)):][:1]
+		}
+		for _, dst := range targets {
+			s.enqueue(dst, batch)
+		}
+	}
+}
+
+func (s *subscriber) destinationsFor(sub Subscription) []*destination {
+	var out []*destination
+	for _, d := range sub.Destinations {
+		if dst := s.dest[d]; dst != nil {
+			out = append(out, dst)
+		}
+	}
+	return out
+}
+
+func (s *subscriber) enqueue(dst *destination, batch pointBatch) {
+	if dst.block {
+		select {
+		case dst.queue <- batch:
+		case <-s.closing:
+		}
+		return
+	}
+
+	select {
+	case dst.queue <- batch:
+	default:
+		// Queue is full: drop the oldest batch to make room, matching the
+		// configured "drop" policy, rather than applying backpressure.
+		select {
+		case oldest := <-dst.queue:
+			dst.stats.dropped.Add(float64(len(oldest.points)))
+		default:
+		}
+		select {
+		case dst.queue <- batch:
+		default:
+			dst.stats.dropped.Add(float64(len(batch.points)))
+		}
+	}
+}
+
+// Close stops every destination's drain goroutine and closes any sink that
+// holds an open connection (e.g. mqttSink, kafkaSink).
+func (s *subscriber) Close() error {
+	if s == nil {
+		return nil
+	}
+	close(s.closing)
+	for _, dst := range s.destinations {
+		dst.wg.Wait()
+		if closer, ok := dst.sink.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+// PrometheusCollectors returns the forwarded/dropped/failed counters for
+// every configured destination.
+func (s *subscriber) PrometheusCollectors() []prometheus.Collector {
+	if s == nil {
+		return nil
+	}
+	var collectors []prometheus.Collector
+	for _, dst := range s.destinations {
+		collectors = append(collectors, dst.stats.forwarded, dst.stats.dropped, dst.stats.failed)
+	}
+	return collectors
+}
@@ -0,0 +1,137 @@
+package udp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// recordingSink is a Sink that records every call to WritePoints, for tests
+// that need to assert what was forwarded without touching the network.
+type recordingSink struct {
+	mu    sync.Mutex
+	calls []pointBatch
+}
+
+func (s *recordingSink) WritePoints(_ context.Context, database, retentionPolicy string, points []models.Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, pointBatch{database: database, retentionPolicy: retentionPolicy, points: points})
+	return nil
+}
+
+func newTestDestination(queueSize int, block bool) *destination {
+	return &destination{
+		dest:  "test://dest",
+		sink:  &recordingSink{},
+		queue: make(chan pointBatch, queueSize),
+		block: block,
+		stats: subscriptionStats{
+			forwarded: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_forwarded_total"}),
+			dropped:   prometheus.NewCounter(prometheus.CounterOpts{Name: "test_dropped_total"}),
+			failed:    prometheus.NewCounter(prometheus.CounterOpts{Name: "test_failed_total"}),
+		},
+	}
+}
+
+func TestSubscriber_Enqueue_DropPolicy(t *testing.T) {
+	s := &subscriber{closing: make(chan struct{})}
+	dst := newTestDestination(1, false)
+
+	first := pointBatch{database: "db", points: make([]models.Point, 1)}
+	second := pointBatch{database: "db", points: make([]models.Point, 2)}
+
+	s.enqueue(dst, first)
+	s.enqueue(dst, second)
+
+	if len(dst.queue) != 1 {
+		t.Fatalf("queue length = %d, want 1", len(dst.queue))
+	}
+	got := <-dst.queue
+	if len(got.points) != len(second.points) {
+		t.Fatalf("queued batch has %d points, want the newer batch's %d (oldest should have been dropped)", len(got.points), len(second.points))
+	}
+}
+
+func TestSubscriber_Enqueue_BlockPolicy(t *testing.T) {
+	s := &subscriber{closing: make(chan struct{})}
+	dst := newTestDestination(1, true)
+
+	s.enqueue(dst, pointBatch{points: make([]models.Point, 1)})
+
+	done := make(chan struct{})
+	go func() {
+		s.enqueue(dst, pointBatch{points: make([]models.Point, 1)})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("enqueue returned while the queue was full under the block policy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(s.closing)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue did not return after closing was closed")
+	}
+}
+
+func TestNewSubscriber_DedupesSharedDestinations(t *testing.T) {
+	subs := []Subscription{
+		{Mode: string(SubscriptionModeAll), Destinations: []string{"http://sink.example"}},
+		{Mode: string(SubscriptionModeAll), Destinations: []string{"http://sink.example", "http://other.example"}},
+	}
+
+	s, err := newSubscriber(subs, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newSubscriber returned error: %s", err)
+	}
+	defer s.Close()
+
+	if len(s.destinations) != 2 {
+		t.Fatalf("got %d destinations, want 2 (shared destination should be deduped)", len(s.destinations))
+	}
+	if s.dest["http://sink.example"] == nil || s.dest["http://other.example"] == nil {
+		t.Fatalf("dest index missing an expected destination: %v", s.dest)
+	}
+	if s.dest["http://sink.example"] == s.dest["http://other.example"] {
+		t.Fatal("distinct destinations unexpectedly share the same *destination")
+	}
+}
+
+func TestSubscriber_Send_ThreadsDatabaseAndRetentionPolicy(t *testing.T) {
+	// Built directly (not via newSubscriber) so no drain goroutine is
+	// running yet; Send's queued batch can be inspected straight off the
+	// channel instead of racing a concurrent sink call.
+	dst := newTestDestination(1, false)
+	s := &subscriber{
+		subs:         []Subscription{{Mode: string(SubscriptionModeAll), Destinations: []string{dst.dest}}},
+		dest:         map[string]*destination{dst.dest: dst},
+		destinations: []*destination{dst},
+		closing:      make(chan struct{}),
+	}
+
+	points := make([]models.Point, 3)
+	s.Send("mydb", "myrp", points)
+
+	select {
+	case batch := <-dst.queue:
+		if batch.database != "mydb" || batch.retentionPolicy != "myrp" {
+			t.Errorf("queued batch database=%q retentionPolicy=%q, want database=%q retentionPolicy=%q",
+				batch.database, batch.retentionPolicy, "mydb", "myrp")
+		}
+		if len(batch.points) != len(points) {
+			t.Errorf("queued batch has %d points, want %d", len(batch.points), len(points))
+		}
+	default:
+		t.Fatal("Send did not enqueue a batch for the destination")
+	}
+}